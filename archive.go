@@ -0,0 +1,403 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"syscall"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/urfave/cli/v2"
+
+	"github.com/MrKoberman/discord-ch-merge/storage"
+)
+
+// manifest records an export archive's format version and message count.
+// Import does not read or check it.
+type manifest struct {
+	FormatVersion int `json:"format_version"`
+	MessageCount  int `json:"message_count"`
+}
+
+const archiveFormatVersion = 1
+
+// exportCommand writes every message currently staged in the store to a
+// tar archive: a messages.jsonl file in timestamp order, an attachments/
+// directory of content-addressed (sha256) files deduplicated by URL, and a
+// manifest.json. This lets a channel's archive outlive the channel itself.
+func exportCommand() *cli.Command {
+	var out, dbKind, dbPath string
+
+	return &cli.Command{
+		Name:  "export",
+		Usage: "export a store's staged messages and attachments to a tar archive",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "out",
+				Usage:       "path of the tar archive to write",
+				Value:       "export.tar",
+				Destination: &out,
+			},
+			&cli.StringFlag{
+				Name:        "store",
+				Usage:       "storage backend the messages are currently staged in",
+				Value:       string(storage.KindPebble),
+				Destination: &dbKind,
+			},
+			&cli.StringFlag{
+				Name:        "db",
+				Usage:       "path of the store to export from",
+				Value:       "msgs.db",
+				Destination: &dbPath,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			db, err := storage.Open(storage.Kind(dbKind), dbPath)
+			if err != nil {
+				return fmt.Errorf("storage.Open: %w", err)
+			}
+			defer db.Close() // nolint: errcheck
+
+			ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			return exportArchive(ctx, db, out)
+		},
+	}
+}
+
+func exportArchive(ctx context.Context, db storage.Store, out string) error {
+	msgs, err := sortedMessages(ctx, db)
+	if err != nil {
+		return fmt.Errorf("sortedMessages: %w", err)
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+
+	tw := tar.NewWriter(f)
+	defer tw.Close() // nolint: errcheck
+
+	var jsonl []byte
+	seenURLs := make(map[string]string) // url -> sha256
+	for i, m := range msgs {
+		for j, a := range m.Attachments {
+			hash, ok := seenURLs[a.URL]
+			if !ok {
+				hash, err = writeAttachment(ctx, tw, a.URL)
+				if err != nil {
+					return fmt.Errorf("writeAttachment: %w", err)
+				}
+				seenURLs[a.URL] = hash
+			}
+			msgs[i].Attachments[j].Filename = a.Filename
+			msgs[i].Attachments[j].URL = path.Join("attachments", hash)
+		}
+
+		b, err := json.Marshal(msgs[i])
+		if err != nil {
+			return err
+		}
+		jsonl = append(jsonl, b...)
+		jsonl = append(jsonl, '\n')
+	}
+
+	if err := writeTarFile(tw, "messages.jsonl", jsonl); err != nil {
+		return fmt.Errorf("writeTarFile messages.jsonl: %w", err)
+	}
+
+	man, err := json.Marshal(manifest{FormatVersion: archiveFormatVersion, MessageCount: len(msgs)})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "manifest.json", man); err != nil {
+		return fmt.Errorf("writeTarFile manifest.json: %w", err)
+	}
+
+	return nil
+}
+
+// sortedMessages reads every non-meta record out of db. Keys are
+// "<timestamp>_<id>", so the store's natural iteration order already sorts
+// them by timestamp.
+func sortedMessages(ctx context.Context, db storage.Store) ([]message, error) {
+	it, err := db.Iter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close() // nolint: errcheck
+
+	var msgs []message
+	for it.First(); it.Valid(); it.Next() {
+		if isMetaKey(it.Key()) {
+			continue
+		}
+		var m message
+		if err := json.Unmarshal(it.Value(), &m); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Timestamp < msgs[j].Timestamp })
+	return msgs, nil
+}
+
+// writeAttachment downloads url and appends it to tw under
+// attachments/<sha256>, returning the hash used as its filename.
+func writeAttachment(ctx context.Context, tw *tar.Writer, url string) (string, error) {
+	f, err := downloadFile(ctx, url)
+	if err != nil {
+		return "", fmt.Errorf("downloadFile: %w", err)
+	}
+	defer os.Remove(f.Name()) // nolint: errcheck
+	defer f.Close()           // nolint: errcheck
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return "", err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name: path.Join("attachments", hash),
+		Mode: 0600,
+		Size: info.Size(),
+	}); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, content []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name: name,
+		Mode: 0600,
+		Size: int64(len(content)),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
+
+// importCommand reads an export archive and replays its messages against a
+// destination channel, disaster-recovering an archived conversation
+// independent of whether the source channel still exists.
+func importCommand() *cli.Command {
+	var in, to, token string
+
+	return &cli.Command{
+		Name:  "import",
+		Usage: "replay an export archive's messages into a destination channel",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "in",
+				Usage:       "path of the tar archive to read",
+				Value:       "export.tar",
+				Destination: &in,
+			},
+			&cli.StringFlag{
+				Name:        "to",
+				EnvVars:     []string{"TO"},
+				Destination: &to,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "token",
+				EnvVars:     []string{"TOKEN"},
+				Destination: &token,
+				Required:    true,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			discord, err := discordgo.New(fmt.Sprintf("Bot %s", token))
+			if err != nil {
+				return fmt.Errorf("discordgo.New: %w", err)
+			}
+
+			ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			return importArchive(ctx, in, to, discord)
+		},
+	}
+}
+
+func importArchive(ctx context.Context, in, to string, discord *discordgo.Session) error {
+	tmpDir, err := os.MkdirTemp("", "discord-ch-merge-import-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir) // nolint: errcheck
+
+	jsonl, attachmentsDir, err := extractArchive(in, tmpDir)
+	if err != nil {
+		return fmt.Errorf("extractArchive: %w", err)
+	}
+
+	rt := newRouter(nil, to)
+	tokens := make(chan struct{}, 4)
+	for _, m := range jsonl {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		job := sendJob{msg: m}
+		files, err := openImportAttachments(m, attachmentsDir)
+		if err != nil {
+			return fmt.Errorf("openImportAttachments: %w", err)
+		}
+		job.files = files
+
+		if err := sendJobMsg(ctx, rt, job, discord, tokens); err != nil {
+			return fmt.Errorf("sendJobMsg: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// openImportAttachments returns a private temp-file copy of each of m's
+// extracted attachments. Export dedupes attachments by URL, so two messages
+// in the archive can reference the same extracted attachments/<sha256>
+// file, while sendJobMsg deletes whatever file it uploads once a message is
+// sent; opening the extracted file directly would make the second message
+// referencing a shared attachment fail to open it.
+func openImportAttachments(m message, attachmentsDir string) ([]*os.File, error) {
+	files := make([]*os.File, 0, len(m.Attachments))
+	for _, a := range m.Attachments {
+		f, err := copyToTemp(path.Join(attachmentsDir, path.Base(a.URL)))
+		if err != nil {
+			return nil, fmt.Errorf("copyToTemp: %w", err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// copyToTemp copies the file at p into a new temp file, seeked back to the
+// start, ready for a caller that will delete its own copy once done with it.
+func copyToTemp(p string) (*os.File, error) {
+	src, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open: %w", err)
+	}
+	defer src.Close() // nolint: errcheck
+
+	tmp, err := os.CreateTemp("", "attachment-*")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()           // nolint: errcheck
+		os.Remove(tmp.Name()) // nolint: errcheck
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, 0); err != nil {
+		tmp.Close()           // nolint: errcheck
+		os.Remove(tmp.Name()) // nolint: errcheck
+		return nil, err
+	}
+
+	return tmp, nil
+}
+
+// extractArchive unpacks in into dir and returns the decoded message
+// records (in archive order) plus the directory attachments were written
+// to.
+func extractArchive(in, dir string) ([]message, string, error) {
+	f, err := os.Open(in)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close() // nolint: errcheck
+
+	attachmentsDir := path.Join(dir, "attachments")
+	if err := os.MkdirAll(attachmentsDir, 0700); err != nil {
+		return nil, "", err
+	}
+
+	var jsonl []byte
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		switch {
+		case hdr.Name == "messages.jsonl":
+			jsonl, err = io.ReadAll(tr)
+			if err != nil {
+				return nil, "", err
+			}
+		case path.Dir(hdr.Name) == "attachments":
+			out, err := os.Create(path.Join(dir, hdr.Name))
+			if err != nil {
+				return nil, "", err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close() // nolint: errcheck
+				return nil, "", err
+			}
+			out.Close() // nolint: errcheck
+		}
+	}
+
+	var msgs []message
+	for _, line := range splitLines(jsonl) {
+		if len(line) == 0 {
+			continue
+		}
+		var m message
+		if err := json.Unmarshal(line, &m); err != nil {
+			return nil, "", err
+		}
+		msgs = append(msgs, m)
+	}
+
+	return msgs, attachmentsDir, nil
+}
+
+func splitLines(b []byte) [][]byte {
+	var lines [][]byte
+	start := 0
+	for i, c := range b {
+		if c == '\n' {
+			lines = append(lines, b[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(b) {
+		lines = append(lines, b[start:])
+	}
+	return lines
+}
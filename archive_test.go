@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+// TestOpenImportAttachmentsSharedURL replays two messages that reference
+// the same export-deduplicated attachment and simulates sendJobMsg's
+// delete-on-send behavior, verifying the second message can still open its
+// copy after the first message's copy has been removed.
+func TestOpenImportAttachmentsSharedURL(t *testing.T) {
+	attachmentsDir := path.Join(t.TempDir(), "attachments")
+	if err := os.MkdirAll(attachmentsDir, 0700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+
+	const hash = "deadbeef"
+	const content = "shared attachment bytes"
+	if err := os.WriteFile(path.Join(attachmentsDir, hash), []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	shared := attachment{Filename: "pic.png", URL: path.Join("attachments", hash)}
+	msgs := []message{
+		{ID: "1", Attachments: []attachment{shared}},
+		{ID: "2", Attachments: []attachment{shared}},
+	}
+
+	for _, m := range msgs {
+		files, err := openImportAttachments(m, attachmentsDir)
+		if err != nil {
+			t.Fatalf("openImportAttachments(%s): %v", m.ID, err)
+		}
+		for _, f := range files {
+			b, err := os.ReadFile(f.Name())
+			if err != nil {
+				t.Fatalf("message %s: read temp copy: %v", m.ID, err)
+			}
+			if string(b) != content {
+				t.Fatalf("message %s: got %q, want %q", m.ID, b, content)
+			}
+			f.Close()           // nolint: errcheck
+			os.Remove(f.Name()) // simulate sendJobMsg's delete-on-send
+		}
+	}
+
+	if _, err := os.Stat(path.Join(attachmentsDir, hash)); err != nil {
+		t.Fatalf("extracted attachment should survive both sends: %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+type loggerKeyType struct{}
+
+var loggerKey loggerKeyType
+
+// withLogger attaches log to ctx so every stage of the pipeline can pull it
+// back out and add its own scope (channel_id, message_id, attachment_url)
+// without every function needing a *slog.Logger parameter threaded through
+// call sites that don't otherwise care about logging.
+func withLogger(ctx context.Context, log *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, log)
+}
+
+// loggerFrom returns the logger attached to ctx, or slog.Default if none
+// was attached.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if log, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return log
+	}
+	return slog.Default()
+}
+
+// newLogger builds the root logger from the --log-format and --log-level
+// flags.
+func newLogger(format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	case "json", "":
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	default:
+		return nil, fmt.Errorf("unknown --log-format %q, want json or text", format)
+	}
+
+	return slog.New(handler), nil
+}
@@ -1,6 +1,7 @@
-// Package main provides a Discord bot that reads msgs from discord channels and stores them in PebbleDB
-// which are then sent to a specified Discord channel. It includes functionality to handle
-// message content and attachments, and ensures proper error handling and resource cleanup.
+// Package main provides a Discord bot that reads msgs from discord channels and stores them in a
+// pluggable key/value store which are then sent to a specified Discord channel. It includes
+// functionality to handle message content and attachments, and ensures proper error handling and
+// resource cleanup.
 package main
 
 import (
@@ -8,18 +9,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/bwmarrin/discordgo"
-	"github.com/cockroachdb/pebble"
-	"github.com/cockroachdb/pebble/bloom"
-	"github.com/go-logr/zapr"
 	"github.com/urfave/cli/v2"
-	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
+
+	"github.com/MrKoberman/discord-ch-merge/storage"
 )
 
 type attachment struct {
@@ -37,32 +38,41 @@ type message struct {
 	Attachments []attachment `json:"attachments"`
 }
 
-func main() {
-	logger, _ := zap.Config{
-		Encoding:    "json",
-		Level:       zap.NewAtomicLevelAt(zapcore.DebugLevel),
-		OutputPaths: []string{"stdout"},
-		EncoderConfig: zapcore.EncoderConfig{
-			MessageKey:   "message",
-			LevelKey:     "level",
-			EncodeLevel:  zapcore.CapitalLevelEncoder,
-			TimeKey:      "time",
-			EncodeTime:   zapcore.ISO8601TimeEncoder,
-			CallerKey:    "caller",
-			EncodeCaller: zapcore.ShortCallerEncoder,
-		},
-	}.Build()
+// cursor marks the last message of a source channel confirmed sent to its
+// destination, so a restarted run can pick up where a previous one left off
+// instead of re-fetching (and potentially re-sending) the channel's entire
+// history.
+type cursor struct {
+	LastMsgID string `json:"last_msg_id"`
+	Timestamp int64  `json:"timestamp"`
+}
 
-	log := zapr.NewLogger(logger)
-	defer logger.Sync() // nolint: errcheck
+func main() {
+	var log *slog.Logger
 
 	conf := struct {
-		from  cli.StringSlice
-		to    string
-		token string
+		from                cli.StringSlice
+		to                  string
+		route               cli.StringSlice
+		token               string
+		resume              bool
+		incremental         bool
+		purgeOnExit         bool
+		store               string
+		fetchConcurrency    int
+		downloadConcurrency int
+		sendConcurrency     int
+		silent              bool
+		noProgress          bool
+		logFormat           string
+		logLevel            string
 	}{}
 
 	app := &cli.App{
+		Commands: []*cli.Command{
+			exportCommand(),
+			importCommand(),
+		},
 		Flags: []cli.Flag{
 			&cli.StringSliceFlag{
 				Name:        "from",
@@ -76,36 +86,147 @@ func main() {
 				Destination: &conf.to,
 				Required:    true,
 			},
+			&cli.StringSliceFlag{
+				Name:        "route",
+				Usage:       "sourceChanID:destChanID, repeatable; overrides --to for that source channel",
+				Destination: &conf.route,
+			},
 			&cli.StringFlag{
 				Name:        "token",
 				EnvVars:     []string{"TOKEN"},
 				Destination: &conf.token,
 				Required:    true,
 			},
+			&cli.BoolFlag{
+				Name:        "resume",
+				Usage:       "replay messages already staged in msgs.db that were never confirmed sent, alongside fetching new ones",
+				Destination: &conf.resume,
+			},
+			&cli.BoolFlag{
+				Name:        "incremental",
+				Usage:       "only fetch messages newer than the last persisted cursor for each source channel",
+				Destination: &conf.incremental,
+			},
+			&cli.BoolFlag{
+				Name:        "purge-on-exit",
+				Usage:       "remove msgs.db on exit instead of leaving it in place for a later --resume run",
+				Destination: &conf.purgeOnExit,
+			},
+			&cli.StringFlag{
+				Name:        "store",
+				Usage:       "storage backend to stage messages in: pebble, bolt, memory, or jsonl",
+				Value:       string(storage.KindPebble),
+				Destination: &conf.store,
+			},
+			&cli.IntFlag{
+				Name:        "fetch-concurrency",
+				Usage:       "number of source channels paginated in parallel",
+				Value:       4,
+				Destination: &conf.fetchConcurrency,
+			},
+			&cli.IntFlag{
+				Name:        "download-concurrency",
+				Usage:       "max number of messages with attachments being downloaded at once",
+				Value:       8,
+				Destination: &conf.downloadConcurrency,
+			},
+			&cli.IntFlag{
+				Name:        "send-concurrency",
+				Usage:       "max number of attachment uploads in flight per sent message",
+				Value:       4,
+				Destination: &conf.sendConcurrency,
+			},
+			&cli.BoolFlag{
+				Name:        "silent",
+				Usage:       "suppress all output, including progress bars",
+				Destination: &conf.silent,
+			},
+			&cli.BoolFlag{
+				Name:        "no-progress",
+				Usage:       "disable progress bars but keep logging",
+				Destination: &conf.noProgress,
+			},
+			&cli.StringFlag{
+				Name:        "log-format",
+				Usage:       "log output format: json or text",
+				Value:       "json",
+				Destination: &conf.logFormat,
+			},
+			&cli.StringFlag{
+				Name:        "log-level",
+				Usage:       "minimum log level: debug, info, warn, or error",
+				Value:       "info",
+				Destination: &conf.logLevel,
+			},
 		},
 		Action: func(c *cli.Context) error {
-			opt := pebbleDBOpt()
+			var err error
+			log, err = newLogger(conf.logFormat, conf.logLevel)
+			if err != nil {
+				return fmt.Errorf("newLogger: %w", err)
+			}
+			if conf.silent {
+				log = slog.New(slog.NewTextHandler(io.Discard, nil))
+			}
+
+			if conf.resume {
+				if _, err := os.Stat("msgs.db"); err != nil {
+					return fmt.Errorf("--resume requires an existing msgs.db from a previous run: %w", err)
+				}
+			}
 
-			db, err := pebble.Open("msgs.db", opt)
+			db, err := storage.Open(storage.Kind(conf.store), "msgs.db")
 			if err != nil {
-				return err
+				return fmt.Errorf("storage.Open: %w", err)
 			}
 			defer func() {
-				os.RemoveAll("msgs.db") // nolint: errcheck
+				if conf.purgeOnExit {
+					os.RemoveAll("msgs.db") // nolint: errcheck
+				}
 			}()
 			defer db.Close() // nolint: errcheck
 
+			ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			ctx = withLogger(ctx, log)
+
 			discord, err := discordgo.New(fmt.Sprintf("Bot %s", conf.token))
 			if err != nil {
 				return fmt.Errorf("discordgo.New: %w", err)
 			}
 
-			if err := getAndStoreMsgs(db, discord, conf.from.Value()); err != nil {
-				return fmt.Errorf("getAndStoreMsgs: %w", err)
+			routes, err := loadRoutes(ctx, db)
+			if err != nil {
+				return fmt.Errorf("loadRoutes: %w", err)
+			}
+			flagRoutes, err := parseRoutes(conf.route.Value())
+			if err != nil {
+				return err
+			}
+			for src, dest := range flagRoutes {
+				routes[src] = dest
+			}
+			if err := saveRoutes(db, routes); err != nil {
+				return fmt.Errorf("saveRoutes: %w", err)
+			}
+			rt := newRouter(routes, conf.to)
+
+			stats := &Stats{}
+			pcfg := pipelineConfig{
+				FetchConcurrency:    conf.fetchConcurrency,
+				DownloadConcurrency: conf.downloadConcurrency,
+				SendConcurrency:     conf.sendConcurrency,
 			}
 
-			if err := readStoredMsgsAndSend(c.Context, db, discord, conf.to); err != nil {
-				return fmt.Errorf("readStoredMsgs: %w", err)
+			progress := startProgress(stats, conf.silent, conf.noProgress)
+			err = runPipeline(ctx, db, discord, pcfg, conf.from.Value(), rt, conf.resume, conf.incremental, stats)
+			progress.finish()
+			if err != nil {
+				if ctx.Err() != nil {
+					log.Info("interrupted, progress persisted for next --resume run")
+					return nil
+				}
+				return fmt.Errorf("runPipeline: %w", err)
 			}
 
 			return nil
@@ -113,40 +234,154 @@ func main() {
 	}
 
 	if err := app.Run(os.Args); err != nil {
-		log.Error(err, "run")
+		if log == nil {
+			log = slog.Default()
+		}
+		log.Error("run failed", "error", err)
 		os.Exit(1)
 	}
 }
 
-func getAndStoreMsgs(db *pebble.DB, discord *discordgo.Session, fromChannelIDs []string) error {
-	for _, from := range fromChannelIDs {
-		beforeID := ""
-		for {
-			msgs, err := discord.ChannelMessages(from, 100, beforeID, "", "")
-			if err != nil {
-				return fmt.Errorf("discord.ChannelMessages: %w", err)
-			}
-			if len(msgs) == 0 {
-				beforeID = ""
-				break
-			}
+// fetchChannel pages a single source channel newest-first, persisting each
+// page as it arrives, then emits every stored message oldest-first onto out
+// so the download/send stages (and reorderStage's bounded reorder window)
+// see messages in chronological order. The cursor itself isn't touched
+// here: it only advances once a message is confirmed sent (see
+// advanceCursor), so an interrupted run never skips a staged-but-unsent
+// message on its next --incremental pass. When incremental is set, paging
+// stops as soon as it reaches the channel's previously persisted cursor.
+func fetchChannel(ctx context.Context, db storage.Store, discord *discordgo.Session, from string, incremental bool, out chan<- message, stats *Stats) error {
+	log := loggerFrom(ctx).With("channel_id", from)
+
+	var since *cursor
+	if incremental {
+		c, err := loadCursor(db, from)
+		if err != nil {
+			err = fmt.Errorf("loadCursor: %w", err)
+			log.Error("failed to load cursor", "error", err)
+			return err
+		}
+		since = c
+	}
 
-			last := len(msgs) - 1
-			beforeID = msgs[last].ID
+	var pending []message // accumulated newest-first; emitted oldest-first below
+	beforeID := ""
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 
-			if err := storeMsgs(db, msgs); err != nil {
-				return fmt.Errorf("storeAllMsgs: %w", err)
-			}
+		msgs, err := discord.ChannelMessages(from, 100, beforeID, "", "")
+		if err != nil {
+			err = fmt.Errorf("discord.ChannelMessages: %w", err)
+			log.Error("failed to fetch messages", "error", err)
+			return err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+
+		if since != nil {
+			msgs = cutoffAt(msgs, since.Timestamp)
+		}
+		if len(msgs) == 0 {
+			break
+		}
+
+		last := len(msgs) - 1
+		beforeID = msgs[last].ID
+
+		stored, err := storeMsgs(ctx, db, msgs)
+		if err != nil {
+			err = fmt.Errorf("storeMsgs: %w", err)
+			log.Error("failed to store messages", "error", err)
+			return err
+		}
+		pending = append(pending, stored...)
+
+		if len(msgs) < 100 {
+			break
 		}
 	}
+
+	for i := len(pending) - 1; i >= 0; i-- {
+		select {
+		case out <- pending[i]:
+			stats.AddFetched()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
 	return nil
 }
 
-func storeMsgs(db *pebble.DB, msgs []*discordgo.Message) error {
-	batch := db.NewBatch()
-	defer batch.Close() // nolint: errcheck
+// cutoffAt drops any message at or before sinceTimestamp, assuming msgs is
+// ordered newest-first as returned by the Discord API.
+func cutoffAt(msgs []*discordgo.Message, sinceTimestamp int64) []*discordgo.Message {
+	for i, msg := range msgs {
+		if msg.Timestamp.UnixMicro() <= sinceTimestamp {
+			return msgs[:i]
+		}
+	}
+	return msgs
+}
+
+func loadCursor(db storage.Store, channelID string) (*cursor, error) {
+	v, err := db.Get(cursorKey(channelID))
+	if err == storage.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var c cursor
+	if err := json.Unmarshal(v, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
 
+func saveCursor(db storage.Store, channelID string, c cursor) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return db.Put(cursorKey(channelID), b)
+}
+
+// advanceCursor persists a new cursor for channelID once a message from it
+// is confirmed sent, but only if ts is newer than whatever cursor is
+// already stored, so cursors only ever move forward.
+func advanceCursor(db storage.Store, channelID, msgID string, ts int64) error {
+	cur, err := loadCursor(db, channelID)
+	if err != nil {
+		return err
+	}
+	if cur != nil && cur.Timestamp >= ts {
+		return nil
+	}
+	return saveCursor(db, channelID, cursor{LastMsgID: msgID, Timestamp: ts})
+}
+
+func cursorKey(channelID string) []byte {
+	return key("cursor", channelID)
+}
+
+func sentKey(to, msgID string) []byte {
+	return key("sent", to, msgID)
+}
+
+// storeMsgs persists msgs and returns them decoded as message values, in
+// the same order, for the caller to hand off downstream.
+func storeMsgs(ctx context.Context, db storage.Store, msgs []*discordgo.Message) ([]message, error) {
+	log := loggerFrom(ctx)
+
+	out := make([]message, 0, len(msgs))
 	for _, msg := range msgs {
+		log := log.With("message_id", msg.ID)
+
 		att := make([]attachment, len(msg.Attachments))
 		for i, a := range msg.Attachments {
 			att[i] = attachment{
@@ -167,36 +402,48 @@ func storeMsgs(db *pebble.DB, msgs []*discordgo.Message) error {
 
 		b, err := json.Marshal(m)
 		if err != nil {
-			return err
+			err = fmt.Errorf("json.Marshal: %w", err)
+			log.Error("failed to encode message", "error", err)
+			return nil, err
 		}
 
-		if err = batch.Set(key(fmt.Sprintf("%d", m.Timestamp), m.ID), b, pebble.Sync); err != nil {
-			return err
+		if err := db.Put(key(fmt.Sprintf("%d", m.Timestamp), m.ID), b); err != nil {
+			err = fmt.Errorf("db.Put: %w", err)
+			log.Error("failed to store message", "error", err)
+			return nil, err
 		}
+		out = append(out, m)
 	}
 
-	return batch.Commit(pebble.Sync)
+	return out, nil
 }
 
 func key(keys ...string) []byte {
 	return []byte(strings.Join(keys, "_"))
 }
 
-func downloadFile(url string) (*os.File, error) {
+func downloadFile(ctx context.Context, url string) (*os.File, error) {
+	log := loggerFrom(ctx).With("attachment_url", url)
+
 	resp, err := http.Get(url)
 	if err != nil {
+		err = fmt.Errorf("http.Get: %w", err)
+		log.Error("failed to download attachment", "error", err)
 		return nil, err
 	}
 	defer resp.Body.Close() // nolint: errcheck
 
 	tmpFile, err := os.CreateTemp("", "attachment-*")
 	if err != nil {
+		log.Error("failed to create temp file for attachment", "error", err)
 		return nil, err
 	}
 
 	_, err = io.Copy(tmpFile, resp.Body)
 	if err != nil {
 		tmpFile.Close() // nolint: errcheck
+		err = fmt.Errorf("io.Copy: %w", err)
+		log.Error("failed to save attachment", "error", err)
 		return nil, err
 	}
 
@@ -209,73 +456,10 @@ func downloadFile(url string) (*os.File, error) {
 	return tmpFile, nil
 }
 
-func pebbleDBOpt() *pebble.Options {
-	opt := &pebble.Options{
-		MaxOpenFiles:                16,
-		MemTableSize:                1<<30 - 1, // Max 1 GB
-		MemTableStopWritesThreshold: 2,
-		// MaxConcurrentCompactions: func() int { return runtime.NumCPU() },
-		Levels: []pebble.LevelOptions{
-			{TargetFileSize: 2 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
-			{TargetFileSize: 2 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
-			{TargetFileSize: 2 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
-			{TargetFileSize: 2 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
-			{TargetFileSize: 2 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
-			{TargetFileSize: 2 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
-			{TargetFileSize: 2 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
-		},
-	}
-	opt.Experimental.ReadSamplingMultiplier = -1
-
-	return opt
-}
-
-func readStoredMsgsAndSend(ctx context.Context, db *pebble.DB, discord *discordgo.Session, toChannelID string) error {
-	it, err := db.NewIterWithContext(ctx, &pebble.IterOptions{})
-	if err != nil {
-		return fmt.Errorf("db.NewIterWithContext: %w", err)
-	}
-	defer it.Close() // nolint: errcheck
-
-	it.First()
-	for ; it.Valid(); it.Next() {
-		var d message
-		err := json.Unmarshal(it.Value(), &d)
-		if err != nil {
-			return fmt.Errorf("json.Unmarshal: %w", err)
-		}
-
-		if err := sendStoredMsg(toChannelID, d, discord); err != nil {
-			return fmt.Errorf("sendStoredMsg: %w", err)
-		}
-	}
-
-	return nil
-}
-
-func sendStoredMsg(to string, msg message, discord *discordgo.Session) error {
-	nmsg, err := discord.ChannelMessageSend(to, fmt.Sprintf("%s: %s", msg.Author, msg.Content))
-	if err != nil {
-		return fmt.Errorf("discord.ChannelMessageSend: %w", err)
-	}
-	if msg.Pinned {
-		err = discord.ChannelMessagePin(to, nmsg.ID)
-		if err != nil {
-			return fmt.Errorf("discord.ChannelMessagePin: %w", err)
-		}
-	}
-	for _, attachment := range msg.Attachments {
-		file, err := downloadFile(attachment.URL)
-		if err != nil {
-			return fmt.Errorf("downloadFile: %w", err)
-		}
-
-		_, err = discord.ChannelFileSend(to, attachment.Filename, file)
-		if err != nil {
-			return fmt.Errorf("discord.ChannelFileSend: %w", err)
-		}
-		os.Remove(file.Name()) // nolint: errcheck
-	}
-
-	return nil
+// isMetaKey reports whether key belongs to bookkeeping state (cursors, sent
+// markers) rather than a stored message, so scans over the whole keyspace
+// can skip it.
+func isMetaKey(k []byte) bool {
+	s := string(k)
+	return strings.HasPrefix(s, "cursor_") || strings.HasPrefix(s, "sent_") || strings.HasPrefix(s, "route_")
 }
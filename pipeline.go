@@ -0,0 +1,412 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+
+	"github.com/MrKoberman/discord-ch-merge/storage"
+)
+
+// pipelineConfig bounds the worker pools used at each stage of the
+// fetch -> download -> send pipeline.
+type pipelineConfig struct {
+	FetchConcurrency    int
+	DownloadConcurrency int
+	SendConcurrency     int
+}
+
+// sendJob is a message paired with any attachments already downloaded to
+// local temp files, ready to be dispatched to the destination channel.
+type sendJob struct {
+	msg   message
+	files []*os.File
+}
+
+// jobHeap orders sendJobs by Timestamp so the send stage replays them in
+// the order they originally appeared in the source channel(s), even though
+// fetching and downloading run concurrently and can finish out of order.
+type jobHeap []sendJob
+
+func (h jobHeap) Len() int            { return len(h) }
+func (h jobHeap) Less(i, j int) bool  { return h[i].msg.Timestamp < h[j].msg.Timestamp }
+func (h jobHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *jobHeap) Push(x interface{}) { *h = append(*h, x.(sendJob)) }
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// runPipeline drives the fetch, download and send stages concurrently:
+// source channels are paginated in parallel (fetchConcurrency), attachment
+// downloads happen with a bounded number in flight (downloadConcurrency),
+// and sends are replayed on a dedicated goroutine that restores timestamp
+// order via a min-heap before handing attachment uploads to a bounded pool
+// (sendConcurrency). ctx cancellation (e.g. SIGINT/SIGTERM) aborts every
+// stage.
+func runPipeline(ctx context.Context, db storage.Store, discord *discordgo.Session, cfg pipelineConfig, from []string, rt *router, resume, incremental bool, stats *Stats) error {
+	stored := make(chan message, 100)
+	ready := make(chan sendJob, 100)
+	ordered := make(chan sendJob, 100)
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		defer close(stored)
+		return fetchStage(ctx, db, discord, from, rt, resume, incremental, cfg.FetchConcurrency, stored, stats)
+	})
+
+	g.Go(func() error {
+		defer close(ready)
+		return downloadStage(ctx, stored, ready, cfg.DownloadConcurrency, stats)
+	})
+
+	g.Go(func() error {
+		defer close(ordered)
+		return reorderStage(ctx, ready, ordered)
+	})
+
+	g.Go(func() error {
+		return sendStage(ctx, db, discord, rt, ordered, cfg.SendConcurrency, stats)
+	})
+
+	return g.Wait()
+}
+
+// fetchStage, when resume is set, replays any previously stored-but-unsent
+// messages (so an interrupted run picks back up without re-downloading)
+// concurrently with paging fresh messages out of each source channel.
+func fetchStage(ctx context.Context, db storage.Store, discord *discordgo.Session, from []string, rt *router, resume, incremental bool, concurrency int, out chan<- message, stats *Stats) error {
+	g, ctx := errgroup.WithContext(ctx)
+
+	if resume {
+		g.Go(func() error {
+			return replayUnsent(ctx, db, rt, out, stats)
+		})
+	}
+
+	tokens := make(chan struct{}, concurrency)
+	for _, src := range from {
+		src := src
+		g.Go(func() error {
+			select {
+			case tokens <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			defer func() { <-tokens }()
+
+			return fetchChannel(ctx, db, discord, src, incremental, out, stats)
+		})
+	}
+
+	return g.Wait()
+}
+
+// replayUnsent feeds already-stored messages that have no sent/<to>/<id>
+// marker into out, so a resumed run finishes delivering them before (or
+// alongside) fetching anything new.
+func replayUnsent(ctx context.Context, db storage.Store, rt *router, out chan<- message, stats *Stats) error {
+	log := loggerFrom(ctx)
+
+	it, err := db.Iter(ctx)
+	if err != nil {
+		err = fmt.Errorf("db.Iter: %w", err)
+		log.Error("failed to replay unsent messages", "error", err)
+		return err
+	}
+	defer it.Close() // nolint: errcheck
+
+	for it.First(); it.Valid(); it.Next() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if isMetaKey(it.Key()) {
+			continue
+		}
+
+		var m message
+		if err := json.Unmarshal(it.Value(), &m); err != nil {
+			err = fmt.Errorf("json.Unmarshal: %w", err)
+			log.Error("failed to decode stored message", "error", err)
+			return err
+		}
+
+		if alreadySent(db, rt.destFor(m.ChannelID), m.ID) {
+			continue
+		}
+
+		select {
+		case out <- m:
+			stats.AddFetched()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// downloadStage consumes stored messages, downloads each one's attachments
+// (bounded by concurrency concurrent messages in flight) and emits a
+// sendJob once everything for that message is ready.
+func downloadStage(ctx context.Context, in <-chan message, out chan<- sendJob, concurrency int, stats *Stats) error {
+	g, ctx := errgroup.WithContext(ctx)
+	tokens := make(chan struct{}, concurrency)
+
+	for m := range in {
+		m := m
+		select {
+		case tokens <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		g.Go(func() error {
+			defer func() { <-tokens }()
+
+			files := make([]*os.File, 0, len(m.Attachments))
+			for _, a := range m.Attachments {
+				f, err := downloadFile(ctx, a.URL)
+				if err != nil {
+					return fmt.Errorf("downloadFile: %w", err)
+				}
+				info, err := f.Stat()
+				if err == nil {
+					stats.AddFile(info.Size())
+				}
+				files = append(files, f)
+			}
+
+			select {
+			case out <- sendJob{msg: m, files: files}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+// reorderWindow bounds how many downloaded jobs reorderStage holds at once.
+// Without a bound it would drain the entire in channel into the heap before
+// emitting anything, defeating the concurrent send stage and accumulating
+// one open attachment temp file per buffered job.
+const reorderWindow = 64
+
+// reorderStage buffers downloaded jobs in a min-heap keyed on message
+// timestamp, emitting the oldest buffered job as soon as the heap grows
+// past reorderWindow entries. Sends start as soon as the window fills
+// rather than waiting for fetch/download to fully drain, at the cost of
+// only guaranteeing order within a window of reorderWindow in-flight jobs.
+func reorderStage(ctx context.Context, in <-chan sendJob, out chan<- sendJob) error {
+	h := &jobHeap{}
+	heap.Init(h)
+
+	for job := range in {
+		heap.Push(h, job)
+
+		for h.Len() > reorderWindow {
+			oldest := heap.Pop(h).(sendJob)
+			select {
+			case out <- oldest:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	for h.Len() > 0 {
+		job := heap.Pop(h).(sendJob)
+		select {
+		case out <- job:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// sendStage replays ordered jobs onto the destination channel one at a
+// time (preserving order) while uploading a job's own attachments
+// concurrently, bounded by concurrency in-flight uploads. Jobs whose
+// destination already has a sent/<to>/<id> marker are skipped, since both
+// replayUnsent and a plain re-fetch of an already-synced channel can hand
+// the same message to this stage twice. Once a job is confirmed sent, its
+// source channel's cursor is advanced so a later --incremental run knows
+// not to re-fetch it.
+func sendStage(ctx context.Context, db storage.Store, discord *discordgo.Session, rt *router, in <-chan sendJob, concurrency int, stats *Stats) error {
+	log := loggerFrom(ctx)
+	tokens := make(chan struct{}, concurrency)
+
+	for job := range in {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		log := log.With("message_id", job.msg.ID)
+		dest := rt.destFor(job.msg.ChannelID)
+		if alreadySent(db, dest, job.msg.ID) {
+			discardJobFiles(job)
+			continue
+		}
+
+		if err := sendJobMsg(ctx, rt, job, discord, tokens); err != nil {
+			err = fmt.Errorf("sendJobMsg: %w", err)
+			log.Error("failed to send message", "error", err)
+			return err
+		}
+
+		if err := db.Put(sentKey(dest, job.msg.ID), []byte(fmt.Sprintf("%d", job.msg.Timestamp))); err != nil {
+			err = fmt.Errorf("db.Put: %w", err)
+			log.Error("failed to persist sent marker", "error", err)
+			return err
+		}
+		if err := advanceCursor(db, job.msg.ChannelID, job.msg.ID, job.msg.Timestamp); err != nil {
+			err = fmt.Errorf("advanceCursor: %w", err)
+			log.Error("failed to advance cursor", "error", err)
+			return err
+		}
+		stats.AddSent()
+	}
+
+	return nil
+}
+
+func sendJobMsg(ctx context.Context, rt *router, job sendJob, discord *discordgo.Session, tokens chan struct{}) error {
+	log := loggerFrom(ctx).With("message_id", job.msg.ID)
+	to := rt.destFor(job.msg.ChannelID)
+	limiter := rt.limiterFor(to)
+
+	var nmsg *discordgo.Message
+	err := sendWithRateLimit(ctx, limiter, func() error {
+		var err error
+		nmsg, err = discord.ChannelMessageSend(to, fmt.Sprintf("%s: %s", job.msg.Author, job.msg.Content))
+		return err
+	})
+	if err != nil {
+		err = fmt.Errorf("discord.ChannelMessageSend: %w", err)
+		log.Error("failed to send message", "error", err)
+		return err
+	}
+	if job.msg.Pinned {
+		err := sendWithRateLimit(ctx, limiter, func() error {
+			return discord.ChannelMessagePin(to, nmsg.ID)
+		})
+		if err != nil {
+			err = fmt.Errorf("discord.ChannelMessagePin: %w", err)
+			log.Error("failed to pin message", "error", err)
+			return err
+		}
+	}
+
+	if len(job.files) == 0 {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(job.files))
+	for i, f := range job.files {
+		select {
+		case tokens <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		wg.Add(1)
+		go func(f *os.File, filename string) {
+			defer wg.Done()
+			defer func() { <-tokens }()
+			defer os.Remove(f.Name()) // nolint: errcheck
+
+			err := sendWithRateLimit(ctx, limiter, func() error {
+				_, err := discord.ChannelFileSend(to, filename, f)
+				return err
+			})
+			if err != nil {
+				err = fmt.Errorf("discord.ChannelFileSend: %w", err)
+				log.Error("failed to send attachment", "error", err, "attachment_filename", filename)
+				errs <- err
+			}
+		}(f, job.msg.Attachments[i].Filename)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendWithRateLimit waits for limiter before calling fn, and on a Discord
+// HTTP 429 response retries with the server-provided Retry-After backoff
+// (falling back to exponential backoff if the header is missing), up to a
+// small number of attempts.
+func sendWithRateLimit(ctx context.Context, limiter *rate.Limiter, fn func() error) error {
+	backoff := time.Second
+	for attempt := 0; attempt < 5; attempt++ {
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		var rerr *discordgo.RESTError
+		if !errors.As(err, &rerr) || rerr.Response == nil || rerr.Response.StatusCode != http.StatusTooManyRequests {
+			return err
+		}
+
+		wait := backoff
+		if ra := rerr.Response.Header.Get("Retry-After"); ra != "" {
+			if d, ok := retryAfter(ra); ok {
+				wait = d
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+
+	return ErrRateLimited
+}
+
+func alreadySent(db storage.Store, to, msgID string) bool {
+	_, err := db.Get(sentKey(to, msgID))
+	return err == nil
+}
+
+// discardJobFiles closes and removes a job's downloaded attachment temp
+// files without uploading them, for a job sendStage decides to skip (e.g.
+// because it was already sent).
+func discardJobFiles(job sendJob) {
+	for _, f := range job.files {
+		f.Close()           // nolint: errcheck
+		os.Remove(f.Name()) // nolint: errcheck
+	}
+}
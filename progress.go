@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// statsFrequency is how often the progress bars are refreshed from Stats.
+const statsFrequency = 500 * time.Millisecond
+
+// progressReporter renders three live bars (messages fetched, attachments
+// downloaded, messages sent) from a shared *Stats on a periodic ticker, so
+// pipeline workers only ever touch lock-free counters.
+type progressReporter struct {
+	stats     *Stats
+	fetched   *progressbar.ProgressBar
+	downloads *progressbar.ProgressBar
+	sent      *progressbar.ProgressBar
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// startProgress starts rendering stats to stderr and returns a reporter
+// whose finish method must be called to finalize the bars before exit. If
+// silent or noProgress is set, it returns a reporter whose methods are
+// no-ops.
+func startProgress(stats *Stats, silent, noProgress bool) *progressReporter {
+	if silent || noProgress {
+		return &progressReporter{}
+	}
+
+	r := &progressReporter{
+		stats:     stats,
+		fetched:   newBar("messages fetched"),
+		downloads: newBytesBar("attachments downloaded"),
+		sent:      newBar("messages sent"),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	go r.run()
+
+	return r
+}
+
+func newBar(description string) *progressbar.ProgressBar {
+	return progressbar.NewOptions64(-1,
+		progressbar.OptionSetDescription(description),
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionShowCount(),
+		progressbar.OptionShowIts(),
+		progressbar.OptionSetItsString("msg/s"),
+	)
+}
+
+// newBytesBar is like newBar but renders its count and rate in byte units
+// (e.g. "12 MB/s"), for tracking attachment throughput rather than a count
+// of items per second.
+func newBytesBar(description string) *progressbar.ProgressBar {
+	return progressbar.NewOptions64(-1,
+		progressbar.OptionSetDescription(description),
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionShowIts(),
+	)
+}
+
+func (r *progressReporter) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(statsFrequency)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.render()
+		case <-r.stop:
+			r.render()
+			return
+		}
+	}
+}
+
+func (r *progressReporter) render() {
+	fetched, _, bytesDownloaded, sent := r.stats.Snapshot()
+	r.fetched.Set64(fetched)           // nolint: errcheck
+	r.downloads.Set64(bytesDownloaded) // nolint: errcheck
+	r.sent.Set64(sent)                 // nolint: errcheck
+}
+
+// finish stops the renderer and marks every bar complete so the terminal is
+// left in a clean state, including when the run was interrupted by
+// SIGINT/SIGTERM.
+func (r *progressReporter) finish() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+
+	r.fetched.Finish()   // nolint: errcheck
+	r.downloads.Finish() // nolint: errcheck
+	r.sent.Finish()      // nolint: errcheck
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/MrKoberman/discord-ch-merge/storage"
+)
+
+// router resolves which destination channel a message should be forwarded
+// to and hands out a per-destination rate limiter honoring Discord's 5
+// messages per 5 seconds per-channel limit, so a single run can fan
+// multiple source channels out to distinct destinations without one busy
+// channel starving another.
+type router struct {
+	mu       sync.Mutex
+	routes   map[string]string // source channel ID -> destination channel ID
+	limiters map[string]*rate.Limiter
+	fallback string // destination used when a source has no --route entry
+}
+
+func newRouter(routes map[string]string, fallback string) *router {
+	return &router{
+		routes:   routes,
+		limiters: make(map[string]*rate.Limiter),
+		fallback: fallback,
+	}
+}
+
+// destFor returns the destination channel a message fetched from
+// srcChannelID should be sent to.
+func (r *router) destFor(srcChannelID string) string {
+	if dest, ok := r.routes[srcChannelID]; ok && dest != "" {
+		return dest
+	}
+	return r.fallback
+}
+
+// limiterFor returns the shared rate.Limiter for dest, creating it on
+// first use.
+func (r *router) limiterFor(dest string) *rate.Limiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l, ok := r.limiters[dest]
+	if !ok {
+		// Discord allows 5 messages per 5 seconds per channel.
+		l = rate.NewLimiter(rate.Every(time.Second), 5)
+		r.limiters[dest] = l
+	}
+	return l
+}
+
+// parseRoutes parses repeated "src:dest" flag values into a map.
+func parseRoutes(raw []string) (map[string]string, error) {
+	routes := make(map[string]string, len(raw))
+	for _, r := range raw {
+		parts := strings.SplitN(r, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid --route %q, want sourceChanID:destChanID", r)
+		}
+		routes[parts[0]] = parts[1]
+	}
+	return routes, nil
+}
+
+func routeKey(src string) []byte {
+	return key("route", src)
+}
+
+// loadRoutes reads any route table persisted by a previous run.
+func loadRoutes(ctx context.Context, db storage.Store) (map[string]string, error) {
+	it, err := db.Iter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close() // nolint: errcheck
+
+	routes := make(map[string]string)
+	prefix := "route_"
+	for it.First(); it.Valid(); it.Next() {
+		k := string(it.Key())
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		routes[strings.TrimPrefix(k, prefix)] = string(it.Value())
+	}
+	return routes, nil
+}
+
+// saveRoutes persists routes so a resumed run reuses them without the
+// caller having to repeat every --route flag.
+func saveRoutes(db storage.Store, routes map[string]string) error {
+	for src, dest := range routes {
+		if err := db.Put(routeKey(src), []byte(dest)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrRateLimited is returned by sendWithRateLimit once its retry budget is
+// exhausted while still being told to back off.
+var ErrRateLimited = errors.New("router: exceeded retry attempts while rate limited")
+
+func retryAfter(headerValue string) (time.Duration, bool) {
+	secs, err := strconv.ParseFloat(headerValue, 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(secs * float64(time.Second)), true
+}
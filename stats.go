@@ -0,0 +1,35 @@
+package main
+
+import "sync/atomic"
+
+// Stats tracks aggregate pipeline throughput across the concurrent
+// fetch/download/send stages. Counters are updated with atomic operations
+// so pipeline workers and the progress renderer never contend on a lock.
+type Stats struct {
+	MessagesFetched int64
+	FilesDownloaded int64
+	BytesDownloaded int64
+	MessagesSent    int64
+}
+
+func (s *Stats) AddFetched() {
+	atomic.AddInt64(&s.MessagesFetched, 1)
+}
+
+func (s *Stats) AddFile(bytes int64) {
+	atomic.AddInt64(&s.FilesDownloaded, 1)
+	atomic.AddInt64(&s.BytesDownloaded, bytes)
+}
+
+func (s *Stats) AddSent() {
+	atomic.AddInt64(&s.MessagesSent, 1)
+}
+
+// Snapshot returns a consistent-enough point-in-time read of the counters
+// for progress rendering; it does not need to be atomic as a whole.
+func (s *Stats) Snapshot() (messagesFetched, filesDownloaded, bytesDownloaded, messagesSent int64) {
+	return atomic.LoadInt64(&s.MessagesFetched),
+		atomic.LoadInt64(&s.FilesDownloaded),
+		atomic.LoadInt64(&s.BytesDownloaded),
+		atomic.LoadInt64(&s.MessagesSent)
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("msgs")
+
+// boltStore is a lighter-weight single-file alternative to Pebble, useful
+// for smaller archival runs where Pebble's LSM machinery is overkill.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBolt(path string) (Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		db.Close() // nolint: errcheck
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Put(key, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(key, value)
+	})
+}
+
+func (s *boltStore) Get(key []byte) ([]byte, error) {
+	var out []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltBucket).Get(key)
+		if v == nil {
+			return ErrNotFound
+		}
+		out = make([]byte, len(v))
+		copy(out, v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Iter loads every key/value pair up front since bbolt cursors are only
+// valid for the lifetime of their enclosing transaction.
+func (s *boltStore) Iter(ctx context.Context) (Iterator, error) {
+	it := &sliceIterator{cur: -1}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(k, v []byte) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			key := make([]byte, len(k))
+			copy(key, k)
+			val := make([]byte, len(v))
+			copy(val, v)
+			it.entries = append(it.entries, kv{key: key, value: val})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+type kv struct {
+	key, value []byte
+}
+
+// sliceIterator implements Iterator over an already-sorted (bbolt iterates
+// its bucket in key order) slice of entries.
+type sliceIterator struct {
+	entries []kv
+	cur     int
+}
+
+func (i *sliceIterator) First() bool {
+	i.cur = 0
+	return i.Valid()
+}
+
+func (i *sliceIterator) Next() bool {
+	i.cur++
+	return i.Valid()
+}
+
+func (i *sliceIterator) Valid() bool   { return i.cur >= 0 && i.cur < len(i.entries) }
+func (i *sliceIterator) Key() []byte   { return i.entries[i.cur].key }
+func (i *sliceIterator) Value() []byte { return i.entries[i.cur].value }
+func (i *sliceIterator) Close() error  { return nil }
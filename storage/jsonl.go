@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+)
+
+// jsonlRecord is one line of a jsonlStore's file: the key and the value,
+// each encoded as base64 so they can hold arbitrary bytes.
+type jsonlRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// jsonlStore keeps entries in memory and rewrites path as one JSON object
+// per line, sorted by key, whenever it's flushed or closed. It trades
+// write amplification for a line-oriented, diffable archive format.
+type jsonlStore struct {
+	mu   sync.Mutex
+	path string
+	data map[string][]byte
+}
+
+func openJSONL(path string) (Store, error) {
+	s := &jsonlStore{path: path, data: make(map[string][]byte)}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec jsonlRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(rec.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := base64.StdEncoding.DecodeString(rec.Value)
+		if err != nil {
+			return nil, err
+		}
+		s.data[string(key)] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *jsonlStore) Put(key, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := make([]byte, len(value))
+	copy(v, value)
+	s.data[string(key)] = v
+	return nil
+}
+
+func (s *jsonlStore) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.data[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	out := make([]byte, len(v))
+	copy(out, v)
+	return out, nil
+}
+
+func (s *jsonlStore) Iter(ctx context.Context) (Iterator, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it := &sliceIterator{cur: -1, entries: make([]kv, 0, len(s.data))}
+	for k, v := range s.data {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		it.entries = append(it.entries, kv{key: []byte(k), value: v})
+	}
+	sort.Slice(it.entries, func(i, j int) bool {
+		return string(it.entries[i].key) < string(it.entries[j].key)
+	})
+	return it, nil
+}
+
+func (s *jsonlStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushLocked()
+}
+
+// flushLocked rewrites the whole file in sorted key order. Callers must
+// hold s.mu.
+func (s *jsonlStore) flushLocked() error {
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	f, err := os.Create(s.path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, k := range keys {
+		rec := jsonlRecord{
+			Key:   base64.StdEncoding.EncodeToString([]byte(k)),
+			Value: base64.StdEncoding.EncodeToString(s.data[k]),
+		}
+		b, err := json.Marshal(rec)
+		if err != nil {
+			f.Close() // nolint: errcheck
+			return err
+		}
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			f.Close() // nolint: errcheck
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close() // nolint: errcheck
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(s.path+".tmp", s.path)
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// memoryStore is an in-memory Store, useful for short runs and for unit
+// tests that exercise storeMsgs/sendStage without standing up a temp DB.
+type memoryStore struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func openMemory() Store {
+	return &memoryStore{data: make(map[string][]byte)}
+}
+
+func (s *memoryStore) Put(key, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := make([]byte, len(value))
+	copy(v, value)
+	s.data[string(key)] = v
+	return nil
+}
+
+func (s *memoryStore) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.data[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	out := make([]byte, len(v))
+	copy(out, v)
+	return out, nil
+}
+
+func (s *memoryStore) Iter(ctx context.Context) (Iterator, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it := &sliceIterator{cur: -1, entries: make([]kv, 0, len(s.data))}
+	for k, v := range s.data {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		it.entries = append(it.entries, kv{key: []byte(k), value: v})
+	}
+	sort.Slice(it.entries, func(i, j int) bool {
+		return string(it.entries[i].key) < string(it.entries[j].key)
+	})
+	return it, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
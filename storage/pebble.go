@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/bloom"
+)
+
+// pebbleStore is the default, durable backend and the one the bot has
+// always used for archival runs of any real size.
+type pebbleStore struct {
+	db *pebble.DB
+}
+
+func openPebble(path string) (Store, error) {
+	opt := &pebble.Options{
+		MaxOpenFiles:                16,
+		MemTableSize:                1<<30 - 1, // Max 1 GB
+		MemTableStopWritesThreshold: 2,
+		Levels: []pebble.LevelOptions{
+			{TargetFileSize: 2 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
+			{TargetFileSize: 2 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
+			{TargetFileSize: 2 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
+			{TargetFileSize: 2 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
+			{TargetFileSize: 2 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
+			{TargetFileSize: 2 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
+			{TargetFileSize: 2 * 1024 * 1024, FilterPolicy: bloom.FilterPolicy(10)},
+		},
+	}
+	opt.Experimental.ReadSamplingMultiplier = -1
+
+	db, err := pebble.Open(path, opt)
+	if err != nil {
+		return nil, err
+	}
+	return &pebbleStore{db: db}, nil
+}
+
+func (s *pebbleStore) Put(key, value []byte) error {
+	return s.db.Set(key, value, pebble.Sync)
+}
+
+func (s *pebbleStore) Get(key []byte) ([]byte, error) {
+	v, closer, err := s.db.Get(key)
+	if err == pebble.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close() // nolint: errcheck
+
+	out := make([]byte, len(v))
+	copy(out, v)
+	return out, nil
+}
+
+func (s *pebbleStore) Iter(ctx context.Context) (Iterator, error) {
+	it, err := s.db.NewIterWithContext(ctx, &pebble.IterOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &pebbleIterator{it: it}, nil
+}
+
+func (s *pebbleStore) Close() error {
+	return s.db.Close()
+}
+
+type pebbleIterator struct {
+	it *pebble.Iterator
+}
+
+func (i *pebbleIterator) First() bool   { return i.it.First() }
+func (i *pebbleIterator) Next() bool    { return i.it.Next() }
+func (i *pebbleIterator) Valid() bool   { return i.it.Valid() }
+func (i *pebbleIterator) Key() []byte   { return i.it.Key() }
+func (i *pebbleIterator) Value() []byte { return i.it.Value() }
+func (i *pebbleIterator) Close() error  { return i.it.Close() }
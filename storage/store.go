@@ -0,0 +1,62 @@
+// Package storage abstracts the key/value persistence the bot uses to
+// stage fetched messages before they're sent on, so the backend can be
+// swapped (Pebble, BoltDB, an in-memory map, or a JSONL file) without the
+// sync/pipeline code depending on any one of them directly.
+package storage
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotFound is returned by Store.Get when key has no value.
+var ErrNotFound = errors.New("storage: key not found")
+
+// Store is the persistence interface the bot depends on. Keys are opaque
+// byte strings; callers (see the key helper in main) encode structure into
+// them with an underscore separator so lexicographic iteration order
+// matches the fields' natural order.
+type Store interface {
+	Put(key, value []byte) error
+	Get(key []byte) ([]byte, error)
+	Iter(ctx context.Context) (Iterator, error)
+	Close() error
+}
+
+// Iterator walks a Store's keys in sorted order, mirroring the subset of
+// pebble.Iterator the rest of the codebase already relies on.
+type Iterator interface {
+	First() bool
+	Next() bool
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Close() error
+}
+
+// Kind selects a Store implementation via the --store flag.
+type Kind string
+
+const (
+	KindPebble Kind = "pebble"
+	KindBolt   Kind = "bolt"
+	KindMemory Kind = "memory"
+	KindJSONL  Kind = "jsonl"
+)
+
+// Open opens the Store backend named by kind at path. path is ignored by
+// the memory backend.
+func Open(kind Kind, path string) (Store, error) {
+	switch kind {
+	case KindPebble, "":
+		return openPebble(path)
+	case KindBolt:
+		return openBolt(path)
+	case KindMemory:
+		return openMemory(), nil
+	case KindJSONL:
+		return openJSONL(path)
+	default:
+		return nil, errors.New("storage: unknown store kind " + string(kind))
+	}
+}